@@ -0,0 +1,315 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OrderedEntry is a single log entry delivered by FetchEntries, tagged with
+// its index within the log so that callers can match it back up to proofs
+// or other by-index state.
+type OrderedEntry struct {
+	Index int64
+	Entry VerifiableEntry
+
+	// LeafHash is the RFC 6962 leaf hash of the raw entry data, provided so
+	// that callers (e.g. Monitor) can fold entries into a running Merkle
+	// tree hash without re-fetching or re-serializing the entry.
+	LeafHash []byte
+}
+
+// FetchOptions controls the behavior of FetchEntries.
+type FetchOptions struct {
+	// Workers is the number of goroutines used to fetch leaves concurrently.
+	// If zero, a sensible default is used.
+	Workers int
+
+	// ChunkSize is the number of contiguous leaves each worker requests per
+	// HTTPS GET. If zero, a sensible default is used.
+	ChunkSize int64
+
+	// RetryBackoff is the initial backoff used when a worker's GET fails.
+	// Each subsequent retry for that chunk doubles the backoff. If zero,
+	// a default of one second is used.
+	RetryBackoff time.Duration
+
+	// MaxRetries is the number of times a worker will retry a failed chunk
+	// before giving up and failing the fetch. If zero, a default of 3 is used.
+	MaxRetries int
+
+	// VerifyAgainst, if set, causes FetchEntries to recompute the RFC 6962
+	// Merkle Tree Hash over every leaf hash it produces and compare it
+	// against VerifyAgainst.RootHash once the fetch completes. This is only
+	// meaningful when start is 0 and VerifyAgainst.TreeSize == end, since
+	// the Merkle Tree Hash is defined over leaves [0, TreeSize); FetchEntries
+	// returns an error if asked to verify any other range.
+	VerifyAgainst *LogTreeHead
+}
+
+const (
+	defaultFetchWorkers   = 10
+	defaultFetchChunkSize = int64(100)
+	defaultMaxRetries     = 3
+)
+
+// fetchChunk is a contiguous, ordered run of leaves as returned by a single
+// worker. chunks are reassembled into order by a min-heap keyed on startIndex.
+type fetchChunk struct {
+	startIndex int64
+	entries    []VerifiableEntry
+	leafHashes [][]byte
+	err        error
+}
+
+// chunkHeap is a container/heap.Interface over fetchChunks, ordered by
+// startIndex, used by the sequencer to hold out-of-order chunks until it is
+// their turn to be delivered.
+type chunkHeap []*fetchChunk
+
+func (h chunkHeap) Len() int            { return len(h) }
+func (h chunkHeap) Less(i, j int) bool  { return h[i].startIndex < h[j].startIndex }
+func (h chunkHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *chunkHeap) Push(x interface{}) { *h = append(*h, x.(*fetchChunk)) }
+func (h *chunkHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// rangeProducer hands out contiguous [start, end) chunk ranges to workers on
+// demand, so that memory use stays proportional to workers*chunkSize rather
+// than to the size of the range being fetched.
+type rangeProducer struct {
+	mu        sync.Mutex
+	next      int64
+	end       int64
+	chunkSize int64
+}
+
+func (p *rangeProducer) nextRange() (int64, int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next >= p.end {
+		return 0, 0, false
+	}
+	start := p.next
+	stop := start + p.chunkSize
+	if stop > p.end {
+		stop = p.end
+	}
+	p.next = stop
+	return start, stop, true
+}
+
+// FetchEntries fans out HTTPS GETs for the leaves [start, end) of this log
+// across opts.Workers goroutines, each pulling a contiguous range of leaves
+// at a time, and reassembles them in strict index order before delivering
+// them on the returned channel. This is intended for callers (bulk
+// exporters, monitors, map mutation replay) that need to read a large
+// contiguous range of a VerifiableLog much faster than one entry at a time.
+//
+// The returned error channel receives at most one error, after which both
+// channels are closed. Callers should drain the entry channel until it
+// closes to avoid leaking the internal worker goroutines; cancelling ctx
+// will also cause both channels to close promptly.
+func (self *VerifiableLog) FetchEntries(ctx context.Context, start, end int64, factory VerifiableEntryFactory, opts FetchOptions) (<-chan OrderedEntry, <-chan error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = defaultFetchWorkers
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultFetchChunkSize
+	}
+	backoff := opts.RetryBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxRetries := opts.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
+	out := make(chan OrderedEntry, chunkSize)
+	errc := make(chan error, 1)
+
+	if start >= end {
+		close(out)
+		close(errc)
+		return out, errc
+	}
+
+	if opts.VerifyAgainst != nil && (start != 0 || opts.VerifyAgainst.TreeSize != end) {
+		close(out)
+		errc <- fmt.Errorf("FetchEntries: VerifyAgainst requires start == 0 and end == %d, got start=%d end=%d", opts.VerifyAgainst.TreeSize, start, end)
+		close(errc)
+		return out, errc
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	chunks := make(chan *fetchChunk, workers)
+	producer := &rangeProducer{next: start, end: end, chunkSize: chunkSize}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				rStart, rEnd, ok := producer.nextRange()
+				if !ok {
+					return
+				}
+				c := self.fetchChunkWithRetry(ctx, rStart, rEnd, end, factory, backoff, maxRetries)
+				select {
+				case chunks <- c:
+					if c.err != nil {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(chunks)
+	}()
+
+	go self.sequenceChunks(ctx, cancel, start, end, chunks, out, errc, opts.VerifyAgainst)
+
+	return out, errc
+}
+
+// fetchChunkWithRetry fetches leaves [start, end) as a single fetchChunk,
+// retrying with doubling backoff on error. treeSize is the overall tree
+// size the whole FetchEntries call was anchored to, and is pinned into
+// every leaf URL regardless of which sub-range chunk a worker happens to
+// be fetching.
+func (self *VerifiableLog) fetchChunkWithRetry(ctx context.Context, start, end, treeSize int64, factory VerifiableEntryFactory, backoff time.Duration, maxRetries int) *fetchChunk {
+	wait := backoff
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return &fetchChunk{startIndex: start, err: ctx.Err()}
+			}
+			wait *= 2
+		}
+		entries, hashes, err := self.fetchLeafRange(ctx, start, end, treeSize, factory)
+		if err == nil {
+			return &fetchChunk{startIndex: start, entries: entries, leafHashes: hashes}
+		}
+		lastErr = err
+	}
+	return &fetchChunk{startIndex: start, err: fmt.Errorf("fetching leaves %d-%d: %w", start, end, lastErr)}
+}
+
+// fetchLeafRange performs the individual per-leaf HTTPS GETs for [start, end)
+// and computes each leaf's RFC 6962 leaf hash as it goes. treeSize, not the
+// sub-range's own end, is the tree size pinned into each leaf's URL, since
+// it is the externally meaningful size the overall fetch was anchored to.
+func (self *VerifiableLog) fetchLeafRange(ctx context.Context, start, end, treeSize int64, factory VerifiableEntryFactory) ([]VerifiableEntry, [][]byte, error) {
+	entries := make([]VerifiableEntry, 0, end-start)
+	hashes := make([][]byte, 0, end-start)
+	for idx := start; idx < end; idx++ {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		default:
+		}
+		data, _, err := self.client.makeRequest("GET", self.path+fmt.Sprintf("/tree/%d/leaf/%d%s", treeSize, idx, factory.Format()), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry, err := factory.CreateFromBytes(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, entry)
+		hashes = append(hashes, leafMerkleTreeHash(data))
+	}
+	return entries, hashes, nil
+}
+
+// sequenceChunks owns the min-heap of chunks keyed by startIndex and is the
+// only goroutine that writes to out/errc. Whenever the heap's top chunk's
+// startIndex equals the next-expected index, it pops the chunk and forwards
+// its entries in order, advancing the cursor. When verifyAgainst is set it
+// also collects every leaf hash and computes the tree hash once, after the
+// last entry has been delivered.
+func (self *VerifiableLog) sequenceChunks(ctx context.Context, cancel context.CancelFunc, start, end int64, chunks <-chan *fetchChunk, out chan<- OrderedEntry, errc chan<- error, verifyAgainst *LogTreeHead) {
+	defer cancel()
+	defer close(out)
+	defer close(errc)
+
+	h := &chunkHeap{}
+	heap.Init(h)
+	next := start
+
+	var leafHashes [][]byte
+	if verifyAgainst != nil {
+		leafHashes = make([][]byte, 0, end-start)
+	}
+
+	for next < end {
+		c, ok := <-chunks
+		if !ok {
+			errc <- fmt.Errorf("fetch ended early: expected entries up to %d, got to %d", end, next)
+			return
+		}
+		if c.err != nil {
+			errc <- c.err
+			return
+		}
+		heap.Push(h, c)
+
+		for h.Len() > 0 && (*h)[0].startIndex == next {
+			top := heap.Pop(h).(*fetchChunk)
+			for i, e := range top.entries {
+				select {
+				case out <- OrderedEntry{Index: top.startIndex + int64(i), Entry: e, LeafHash: top.leafHashes[i]}:
+				case <-ctx.Done():
+					errc <- ctx.Err()
+					return
+				}
+			}
+			if verifyAgainst != nil {
+				leafHashes = append(leafHashes, top.leafHashes...)
+			}
+			next += int64(len(top.entries))
+		}
+	}
+
+	if verifyAgainst != nil {
+		root := computeMTH(leafHashes)
+		if !bytes.Equal(root, verifyAgainst.RootHash) {
+			errc <- fmt.Errorf("FetchEntries: recomputed root %x does not match pinned LogTreeHead root %x at size %d", root, verifyAgainst.RootHash, verifyAgainst.TreeSize)
+		}
+	}
+}
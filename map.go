@@ -20,9 +20,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -69,32 +66,6 @@ func (self *VerifiableMap) Create() error {
 	return nil
 }
 
-func parseHeadersForProof(headers http.Header) ([][]byte, error) {
-	prv := make([][]byte, 256)
-	actualHeaders, ok := headers[http.CanonicalHeaderKey("X-Verified-Proof")]
-	if ok {
-		for _, h := range actualHeaders {
-			for _, commad := range strings.Split(h, ",") {
-				bits := strings.SplitN(commad, "/", 2)
-				if len(bits) == 2 {
-					idx, err := strconv.Atoi(strings.TrimSpace(bits[0]))
-					if err != nil {
-						return nil, err
-					}
-					bs, err := hex.DecodeString(strings.TrimSpace(bits[1]))
-					if err != nil {
-						return nil, err
-					}
-					if idx < 256 {
-						prv[idx] = bs
-					}
-				}
-			}
-		}
-	}
-	return prv, nil
-}
-
 // Get will return the value for the given key at the given treeSize. Pass continusec.Head
 // to always get the latest value. factory is normally one of RawDataEntryFactory, JsonEntryFactory or RedactedJsonEntryFactory.
 func (self *VerifiableMap) Get(key []byte, treeSize int64, factory VerifiableEntryFactory) (*MapInclusionProof, error) {
@@ -103,7 +74,7 @@ func (self *VerifiableMap) Get(key []byte, treeSize int64, factory VerifiableEnt
 		return nil, err
 	}
 
-	prv, err := parseHeadersForProof(headers)
+	ph, err := ParseProofHeaders(headers)
 	if err != nil {
 		return nil, err
 	}
@@ -113,15 +84,10 @@ func (self *VerifiableMap) Get(key []byte, treeSize int64, factory VerifiableEnt
 		return nil, err
 	}
 
-	vts, err := strconv.Atoi(headers.Get("X-Verified-TreeSize"))
-	if err != nil {
-		return nil, err
-	}
-
 	return &MapInclusionProof{
 		Value:     rv,
-		TreeSize:  int64(vts),
-		AuditPath: prv,
+		TreeSize:  ph.VerifiedTreeSize,
+		AuditPath: ph.MapAuditPath,
 		Key:       key,
 	}, nil
 }
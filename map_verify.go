@@ -0,0 +1,87 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// errInvalidMapInclusionProof is returned by verifyMapInclusionProof when
+// the recomputed root does not match the pinned root it was checked
+// against.
+var errInvalidMapInclusionProof = errors.New("continusec: map inclusion proof does not verify against pinned root")
+
+// emptySubtreeHashes returns, for each level 0..depth, the hash of an empty
+// subtree at that level: level 0 is the hash of an absent leaf, and each
+// subsequent level is the node hash of two empty subtrees at the level
+// below. This lets verifyMapInclusionProof treat a missing AuditPath entry
+// (a key whose sibling subtree is empty) the same way the server does.
+func emptySubtreeHashes(depth int) [][]byte {
+	hashes := make([][]byte, depth+1)
+	hashes[0] = leafMerkleTreeHash(nil)
+	for i := 1; i <= depth; i++ {
+		hashes[i] = nodeMerkleTreeHash(hashes[i-1], hashes[i-1])
+	}
+	return hashes
+}
+
+// keyBit returns bit i (0 = least significant, counting from the leaf level
+// upward) of SHA-256(key).
+func keyBit(key []byte, i int) int {
+	sum := sha256.Sum256(key)
+	byteIdx := len(sum) - 1 - i/8
+	if byteIdx < 0 {
+		return 0
+	}
+	return int((sum[byteIdx] >> uint(i%8)) & 1)
+}
+
+// verifyMapInclusionProof recomputes the sparse Merkle tree root implied by
+// proof and compares it against rootHash, returning nil if and only if
+// proof is a valid inclusion (or non-inclusion, for a nil Value) proof for
+// key under rootHash.
+func verifyMapInclusionProof(key []byte, proof *MapInclusionProof, rootHash []byte) error {
+	depth := len(proof.AuditPath)
+	empties := emptySubtreeHashes(depth)
+
+	var leaf []byte
+	if proof.Value == nil {
+		leaf = empties[0]
+	} else {
+		leaf = leafMerkleTreeHash(proof.Value.Data())
+	}
+
+	hash := leaf
+	for i := 0; i < depth; i++ {
+		sibling := proof.AuditPath[i]
+		if sibling == nil {
+			sibling = empties[i]
+		}
+		if keyBit(key, i) == 0 {
+			hash = nodeMerkleTreeHash(hash, sibling)
+		} else {
+			hash = nodeMerkleTreeHash(sibling, hash)
+		}
+	}
+
+	if !bytes.Equal(hash, rootHash) {
+		return errInvalidMapInclusionProof
+	}
+	return nil
+}
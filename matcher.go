@@ -0,0 +1,216 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MutationKind identifies whether a mutation log entry was a Set or a
+// Delete of a map key.
+type MutationKind string
+
+const (
+	// SetMutation is the mutation kind recorded by VerifiableMap.Set.
+	SetMutation MutationKind = "set"
+	// DeleteMutation is the mutation kind recorded by VerifiableMap.Delete.
+	DeleteMutation MutationKind = "delete"
+)
+
+// mutationRecord is the envelope a mutation log entry is encoded as. Value
+// is only populated for SetMutation entries, and holds whatever JSON
+// document the entry's VerifiableEntryFactory (normally
+// RedactedJsonEntryFactory) decoded the mutated value to.
+type mutationRecord struct {
+	Action string          `json:"action"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// Match is a single hit reported by a Matcher for a given log entry.
+type Match struct {
+	// MatcherName identifies which Matcher produced this hit, for
+	// routing and logging.
+	MatcherName string
+	// Key is the map key the matched mutation applies to, if known.
+	Key []byte
+	// Description is a short, human-readable explanation of the hit.
+	Description string
+}
+
+// Matcher inspects a single decoded log entry and reports zero or more
+// Matches. Implementations must not retain entry beyond the call.
+type Matcher interface {
+	Match(entry VerifiableEntry, index int64) ([]Match, error)
+}
+
+// MatchContext carries the verified inclusion context a sink needs to make
+// sense of a Match: which entry it came from, and the tree head it was
+// verified under.
+type MatchContext struct {
+	Index int64
+	Entry VerifiableEntry
+	Head  *LogTreeHead
+}
+
+// MatchSink receives every Match produced while tailing a log.
+type MatchSink func(ctx MatchContext, match Match)
+
+// MatchErrorSink receives a Matcher's error for a given entry. A Matcher
+// error never aborts the stream; it is only reported here.
+type MatchErrorSink func(index int64, matcherName string, err error)
+
+func mutationKeyPrefixString(entry VerifiableEntry) (*mutationRecord, []byte, error) {
+	var rec mutationRecord
+	if err := json.Unmarshal(entry.Data(), &rec); err != nil {
+		return nil, nil, fmt.Errorf("decoding mutation entry: %w", err)
+	}
+	key, err := hex.DecodeString(rec.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding mutation key %q: %w", rec.Key, err)
+	}
+	return &rec, key, nil
+}
+
+// KeyPrefixMatcher matches mutation log entries whose key starts with
+// Prefix.
+type KeyPrefixMatcher struct {
+	Prefix []byte
+}
+
+// Match implements Matcher.
+func (m *KeyPrefixMatcher) Match(entry VerifiableEntry, index int64) ([]Match, error) {
+	_, key, err := mutationKeyPrefixString(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < len(m.Prefix) || !bytesHasPrefix(key, m.Prefix) {
+		return nil, nil
+	}
+	return []Match{{
+		MatcherName: "KeyPrefixMatcher",
+		Key:         key,
+		Description: fmt.Sprintf("key %x has prefix %x", key, m.Prefix),
+	}}, nil
+}
+
+func bytesHasPrefix(b, prefix []byte) bool {
+	if len(b) < len(prefix) {
+		return false
+	}
+	for i, p := range prefix {
+		if b[i] != p {
+			return false
+		}
+	}
+	return true
+}
+
+// MutationKindMatcher matches mutation log entries of the given kind (Set
+// or Delete).
+type MutationKindMatcher struct {
+	Kind MutationKind
+}
+
+// Match implements Matcher.
+func (m *MutationKindMatcher) Match(entry VerifiableEntry, index int64) ([]Match, error) {
+	rec, key, err := mutationKeyPrefixString(entry)
+	if err != nil {
+		return nil, err
+	}
+	if MutationKind(rec.Action) != m.Kind {
+		return nil, nil
+	}
+	return []Match{{
+		MatcherName: "MutationKindMatcher",
+		Key:         key,
+		Description: fmt.Sprintf("key %x mutated via %s", key, rec.Action),
+	}}, nil
+}
+
+// JSONPathMatcher matches mutation log entries, decoded as JSON via
+// RedactedJsonEntryFactory, whose value at a dotted Path (e.g.
+// "address.city") either equals Equals or contains Contains as a
+// substring. Set exactly one of Equals or Contains.
+type JSONPathMatcher struct {
+	Path     string
+	Equals   *string
+	Contains *string
+}
+
+// Match implements Matcher.
+func (m *JSONPathMatcher) Match(entry VerifiableEntry, index int64) ([]Match, error) {
+	rec, key, err := mutationKeyPrefixString(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(rec.Value) == 0 {
+		// Deletes (and any Set recorded without a value payload) have
+		// nothing for a JSON path to resolve against.
+		return nil, nil
+	}
+
+	var value map[string]interface{}
+	if err := json.Unmarshal(rec.Value, &value); err != nil {
+		return nil, fmt.Errorf("decoding mutated value for path match: %w", err)
+	}
+
+	found, ok := jsonPathLookup(value, strings.Split(m.Path, "."))
+	if !ok {
+		return nil, nil
+	}
+	str, ok := found.(string)
+	if !ok {
+		return nil, nil
+	}
+
+	switch {
+	case m.Equals != nil && m.Contains != nil:
+		return nil, fmt.Errorf("JSONPathMatcher: exactly one of Equals or Contains must be set")
+	case m.Equals != nil:
+		if str != *m.Equals {
+			return nil, nil
+		}
+		return []Match{{MatcherName: "JSONPathMatcher", Key: key, Description: fmt.Sprintf("%s == %q", m.Path, str)}}, nil
+	case m.Contains != nil:
+		if !strings.Contains(str, *m.Contains) {
+			return nil, nil
+		}
+		return []Match{{MatcherName: "JSONPathMatcher", Key: key, Description: fmt.Sprintf("%s contains %q", m.Path, *m.Contains)}}, nil
+	default:
+		return nil, fmt.Errorf("JSONPathMatcher: exactly one of Equals or Contains must be set")
+	}
+}
+
+func jsonPathLookup(value map[string]interface{}, path []string) (interface{}, bool) {
+	cur := interface{}(value)
+	for _, segment := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok := m[segment]
+		if !ok {
+			return nil, false
+		}
+		cur = v
+	}
+	return cur, true
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import "crypto/sha256"
+
+// RFC 6962 domain separation prefixes for leaf and interior nodes.
+const (
+	leafHashPrefix = 0x00
+	nodeHashPrefix = 0x01
+)
+
+// leafMerkleTreeHash returns the RFC 6962 leaf hash for the given leaf data.
+func leafMerkleTreeHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafHashPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// nodeMerkleTreeHash returns the RFC 6962 interior node hash for a pair of
+// child hashes.
+func nodeMerkleTreeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodeHashPrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// computeMTH computes the RFC 6962 Merkle Tree Hash for a contiguous,
+// ordered slice of leaf hashes, using the standard recursive split at the
+// largest power of two less than len(leafHashes).
+func computeMTH(leafHashes [][]byte) []byte {
+	switch len(leafHashes) {
+	case 0:
+		return sha256.New().Sum(nil)
+	case 1:
+		return leafHashes[0]
+	default:
+		k := largestPowerOfTwoLessThan(len(leafHashes))
+		left := computeMTH(leafHashes[:k])
+		right := computeMTH(leafHashes[k:])
+		return nodeMerkleTreeHash(left, right)
+	}
+}
+
+// largestPowerOfTwoLessThan returns the largest power of two strictly less
+// than n, for n > 1.
+func largestPowerOfTwoLessThan(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
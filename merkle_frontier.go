@@ -0,0 +1,86 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import "crypto/sha256"
+
+// merkleFrontier is a compact representation of a Merkle tree: one hash per
+// set bit of Size, each the root of a complete subtree ending at Size. It
+// lets callers append leaves one at a time and recover the current root
+// without retaining the full leaf history. It does not compare two
+// frontiers or check a consistency proof between two sizes.
+type merkleFrontier struct {
+	Size  int64    `json:"size"`
+	Nodes [][]byte `json:"nodes"`
+}
+
+// append extends the frontier by one leaf hash, following the standard
+// incremental Merkle tree algorithm: carry upward combining complete
+// subtrees, the same way a binary counter carries.
+func (f *merkleFrontier) append(leafHash []byte) {
+	hash := leafHash
+	size := f.Size
+	i := 0
+	for size&1 == 1 {
+		hash = nodeMerkleTreeHash(f.Nodes[i], hash)
+		size >>= 1
+		i++
+	}
+	if i < len(f.Nodes) {
+		f.Nodes[i] = hash
+	} else {
+		f.Nodes = append(f.Nodes, hash)
+	}
+	f.Size++
+}
+
+// root returns the Merkle Tree Hash of the tree as it stands at f.Size, by
+// combining the complete subtree hashes from the lowest level up: the
+// lowest set bit is the rightmost, most-recently-completed subtree, so it
+// must be the innermost (first-computed) term the higher levels fold onto,
+// not the other way around.
+func (f *merkleFrontier) root() []byte {
+	if f.Size == 0 {
+		return sha256.New().Sum(nil)
+	}
+	var hash []byte
+	for i := 0; i < len(f.Nodes); i++ {
+		if f.Size&(int64(1)<<uint(i)) == 0 {
+			continue
+		}
+		if hash == nil {
+			hash = f.Nodes[i]
+		} else {
+			hash = nodeMerkleTreeHash(f.Nodes[i], hash)
+		}
+	}
+	return hash
+}
+
+// clone returns a deep copy, so speculative appends can be rolled back on
+// verification failure without corrupting the last-known-good frontier.
+func (f *merkleFrontier) clone() *merkleFrontier {
+	nodes := make([][]byte, len(f.Nodes))
+	for i, n := range f.Nodes {
+		if n != nil {
+			cp := make([]byte, len(n))
+			copy(cp, n)
+			nodes[i] = cp
+		}
+	}
+	return &merkleFrontier{Size: f.Size, Nodes: nodes}
+}
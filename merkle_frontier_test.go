@@ -0,0 +1,41 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestMerkleFrontierRootMatchesComputeMTH(t *testing.T) {
+	const maxN = 500
+
+	f := &merkleFrontier{}
+	var leafHashes [][]byte
+	for n := 0; n <= maxN; n++ {
+		want := computeMTH(leafHashes)
+		if got := f.root(); !bytes.Equal(got, want) {
+			t.Fatalf("size %d: root() = %x, want %x (from computeMTH)", n, got, want)
+		}
+
+		leaf := sha256.Sum256([]byte{byte(n), byte(n >> 8)})
+		leafHash := leafMerkleTreeHash(leaf[:])
+		leafHashes = append(leafHashes, leafHash)
+		f.append(leafHash)
+	}
+}
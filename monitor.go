@@ -0,0 +1,370 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MonitorEventKind identifies the kind of MonitorEvent emitted by a Monitor.
+type MonitorEventKind int
+
+const (
+	// NewTreeHead is emitted each time a log's tree head grows and the new
+	// entries have been verified.
+	NewTreeHead MonitorEventKind = iota
+	// InconsistencyDetected is emitted when the root hash recomputed
+	// locally from newly-fetched leaves does not match the tree head the
+	// server reported for that size.
+	InconsistencyDetected
+	// GapDetected is emitted when the server reports a tree head whose
+	// leaves cannot be reconciled with the locally persisted frontier,
+	// e.g. because the log appears to have shrunk.
+	GapDetected
+)
+
+// MonitorEvent is delivered on a Monitor's event channel as it tails a log.
+type MonitorEvent struct {
+	Kind MonitorEventKind
+	Log  string // "mutation" or "treehead"
+	Head *LogTreeHead
+	Err  error
+}
+
+// monitorLogState is the persisted, per-log state that lets a Monitor
+// resume exactly where it left off after a restart.
+type monitorLogState struct {
+	Size     int64           `json:"size"`
+	RootHash []byte          `json:"root_hash"`
+	Frontier *merkleFrontier `json:"frontier"`
+}
+
+// monitorState is the full contents of a Monitor's state file.
+type monitorState struct {
+	Mutation monitorLogState `json:"mutation"`
+	TreeHead monitorLogState `json:"tree_head"`
+}
+
+// Monitor tails a VerifiableMap's mutation and tree head logs, verifying
+// consistency locally as it goes and persisting progress to disk so that a
+// restart resumes rather than re-verifies from scratch. Construct one with
+// VerifiableMap.NewMonitor.
+type Monitor struct {
+	Map     *VerifiableMap
+	Factory VerifiableEntryFactory
+
+	// PollInterval is the initial delay between polls when no new tree
+	// head is found; it doubles on each empty poll, the same as
+	// BlockUntilSize, and resets whenever a new tree head is seen.
+	PollInterval time.Duration
+
+	// FetchOptions is passed through to the underlying FetchEntries calls
+	// used to catch up on new leaves.
+	FetchOptions FetchOptions
+
+	Events chan MonitorEvent
+
+	// Matchers, Sink and MatchErrors turn this Monitor into an
+	// event-driven audit pipeline: every mutation log entry is run
+	// through each Matcher as it is verified, hits are delivered to Sink
+	// along with their verified inclusion context, and per-entry Matcher
+	// errors are delivered to MatchErrors rather than aborting the
+	// stream. Both may be left nil to just tail and verify.
+	Matchers    []Matcher
+	Sink        MatchSink
+	MatchErrors MatchErrorSink
+
+	statePath string
+	state     monitorState
+}
+
+// NewMonitor creates a Monitor for this map that persists its state under
+// stateDir. If stateDir already contains state from a previous run, it is
+// loaded and the monitor resumes from it; otherwise the monitor starts from
+// tree size zero for both logs. factory is used to decode mutation log
+// entries as they are fetched.
+func (self *VerifiableMap) NewMonitor(stateDir string, factory VerifiableEntryFactory) (*Monitor, error) {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, err
+	}
+	m := &Monitor{
+		Map:          self,
+		Factory:      factory,
+		PollInterval: time.Second,
+		Events:       make(chan MonitorEvent, 16),
+		statePath:    filepath.Join(stateDir, "monitor_state.json"),
+		state: monitorState{
+			Mutation: monitorLogState{Frontier: &merkleFrontier{}},
+			TreeHead: monitorLogState{Frontier: &merkleFrontier{}},
+		},
+	}
+	if err := m.loadState(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Monitor) loadState() error {
+	contents, err := ioutil.ReadFile(m.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var s monitorState
+	if err := json.Unmarshal(contents, &s); err != nil {
+		return err
+	}
+	m.state = s
+	if m.state.Mutation.Frontier == nil {
+		m.state.Mutation.Frontier = &merkleFrontier{}
+	}
+	if m.state.TreeHead.Frontier == nil {
+		m.state.TreeHead.Frontier = &merkleFrontier{}
+	}
+	return nil
+}
+
+// saveState persists m.state to disk via tmpfile+rename so that a crash
+// mid-write never leaves a corrupt or partially-written state file behind.
+func (m *Monitor) saveState() error {
+	contents, err := json.Marshal(m.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(m.statePath), ".monitor_state-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, m.statePath)
+}
+
+// Run polls both the mutation log and the tree head log until ctx is
+// cancelled, verifying and persisting progress as it goes, and emitting a
+// MonitorEvent for each new tree head, inconsistency or gap. It returns the
+// context's error when ctx is cancelled.
+func (m *Monitor) Run(ctx context.Context) error {
+	defer close(m.Events)
+	wait := m.PollInterval
+	if wait <= 0 {
+		wait = time.Second
+	}
+	for {
+		grew, err := m.poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if grew {
+			wait = m.PollInterval
+			if wait <= 0 {
+				wait = time.Second
+			}
+		} else {
+			wait *= 2
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// poll checks both logs once, catching each up to the latest tree head if
+// it has grown. It returns true if either log grew.
+func (m *Monitor) poll(ctx context.Context) (bool, error) {
+	head, err := m.Map.TreeHead(Head)
+	if err != nil {
+		return false, err
+	}
+
+	grewMutation, err := m.syncLog(ctx, "mutation", m.Map.MutationLog(), m.Factory, &m.state.Mutation, head.MutationLogTreeHead)
+	if err != nil {
+		return false, err
+	}
+
+	grewTreeHead, err := m.syncLog(ctx, "treehead", m.Map.TreeHeadLog(), RawDataEntryFactory, &m.state.TreeHead, LogTreeHead{})
+	if err != nil {
+		return false, err
+	}
+
+	if grewMutation || grewTreeHead {
+		if err := m.saveState(); err != nil {
+			return false, err
+		}
+	}
+	return grewMutation || grewTreeHead, nil
+}
+
+// sendEvent delivers ev on m.Events, guarding the send against ctx
+// cancellation so that a caller who stops draining Events can never wedge
+// Run forever. On success it returns ev.Err (nil for a NewTreeHead event,
+// the underlying problem for a GapDetected/InconsistencyDetected one) so
+// callers can propagate it in the same expression; on cancellation it
+// returns ctx.Err() instead.
+func (m *Monitor) sendEvent(ctx context.Context, ev MonitorEvent) error {
+	select {
+	case m.Events <- ev:
+		return ev.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// syncLog fetches and verifies any leaves newly available in log beyond
+// state.Size, bringing the local frontier up to the log's current tree
+// size. If target.TreeSize is non-zero it is used as the size to catch up
+// to (the mutation log, whose latest size is known from the map's tree
+// head); otherwise the log's own TreeHead(Head) is consulted (the tree
+// head log, whose size the map response doesn't carry).
+func (m *Monitor) syncLog(ctx context.Context, name string, log *VerifiableLog, factory VerifiableEntryFactory, state *monitorLogState, target LogTreeHead) (bool, error) {
+	newSize := target.TreeSize
+	if newSize == 0 {
+		lth, err := log.TreeHead(Head)
+		if err != nil {
+			return false, err
+		}
+		newSize = lth.TreeSize
+	}
+
+	if newSize < state.Size {
+		return false, m.sendEvent(ctx, MonitorEvent{Kind: GapDetected, Log: name, Err: fmt.Errorf("%s log shrank from %d to %d", name, state.Size, newSize)})
+	}
+	if newSize == state.Size {
+		return false, nil
+	}
+
+	frontier := state.Frontier.clone()
+	needEntries := name == "treehead" || (name == "mutation" && len(m.Matchers) > 0)
+	var fetched []OrderedEntry
+	if needEntries {
+		fetched = make([]OrderedEntry, 0, newSize-state.Size)
+	}
+	out, errc := log.FetchEntries(ctx, state.Size, newSize, factory, m.FetchOptions)
+	for entry := range out {
+		frontier.append(entry.LeafHash)
+		if needEntries {
+			fetched = append(fetched, entry)
+		}
+	}
+	if err := <-errc; err != nil {
+		return false, err
+	}
+	root := frontier.root()
+
+	serverHead, err := log.TreeHead(newSize)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(root, serverHead.RootHash) {
+		err := fmt.Errorf("%s log: root recomputed locally at size %d (%x) does not match server (%x)", name, newSize, root, serverHead.RootHash)
+		return false, m.sendEvent(ctx, MonitorEvent{Kind: InconsistencyDetected, Log: name, Err: err})
+	}
+
+	if name == "treehead" {
+		if err := m.verifyTreeHeadLogEntries(ctx, fetched); err != nil {
+			return false, err
+		}
+	}
+
+	state.Frontier = frontier
+	state.Size = newSize
+	state.RootHash = root
+
+	head := &LogTreeHead{TreeSize: newSize, RootHash: root}
+	if name == "mutation" && len(m.Matchers) > 0 {
+		m.runMatchers(fetched, head)
+	}
+
+	if err := m.sendEvent(ctx, MonitorEvent{Kind: NewTreeHead, Log: name, Head: head}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// verifyTreeHeadLogEntries decodes each tree-head-log entry's embedded map
+// root and the mutation log size it claims, and cross-checks both against
+// a live VerifiableMap.TreeHead call at that claimed size, so that a
+// tree-head-log entry can never silently assert a map root that doesn't
+// match what the mutation log actually produces at that size.
+func (m *Monitor) verifyTreeHeadLogEntries(ctx context.Context, entries []OrderedEntry) error {
+	for _, oe := range entries {
+		var claimed mapHashResponse
+		if err := json.Unmarshal(oe.Entry.Data(), &claimed); err != nil {
+			return fmt.Errorf("decoding tree head log entry %d: %w", oe.Index, err)
+		}
+
+		live, err := m.Map.TreeHead(claimed.LogSTH.TreeSize)
+		if err != nil {
+			return fmt.Errorf("fetching map tree head at mutation log size %d claimed by tree head log entry %d: %w", claimed.LogSTH.TreeSize, oe.Index, err)
+		}
+
+		if !bytes.Equal(live.RootHash, claimed.MapHash) ||
+			live.MutationLogTreeHead.TreeSize != claimed.LogSTH.TreeSize ||
+			!bytes.Equal(live.MutationLogTreeHead.RootHash, claimed.LogSTH.Hash) {
+			err := fmt.Errorf("tree head log entry %d: embedded map root does not match the map's actual tree head at mutation log size %d", oe.Index, claimed.LogSTH.TreeSize)
+			return m.sendEvent(ctx, MonitorEvent{Kind: InconsistencyDetected, Log: "treehead", Err: err})
+		}
+	}
+	return nil
+}
+
+// runMatchers decodes and runs every registered Matcher over each newly
+// verified mutation log entry, routing hits to Sink and per-entry errors to
+// MatchErrors. A Matcher error on one entry never stops matching on the
+// rest of the batch or aborts the stream.
+func (m *Monitor) runMatchers(entries []OrderedEntry, head *LogTreeHead) {
+	for _, oe := range entries {
+		for _, matcher := range m.Matchers {
+			matches, err := matcher.Match(oe.Entry, oe.Index)
+			if err != nil {
+				if m.MatchErrors != nil {
+					m.MatchErrors(oe.Index, fmt.Sprintf("%T", matcher), err)
+				}
+				continue
+			}
+			if m.Sink == nil {
+				continue
+			}
+			ctx := MatchContext{Index: oe.Index, Entry: oe.Entry, Head: head}
+			for _, match := range matches {
+				m.Sink(ctx, match)
+			}
+		}
+	}
+}
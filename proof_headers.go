@@ -0,0 +1,231 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Header names for every proof-bearing response in the API. One semantic
+// field, one header key, no overloading.
+const (
+	HeaderVerifiedProof      = "X-Verified-Proof"
+	HeaderVerifiedTreeSize   = "X-Verified-TreeSize"
+	HeaderInclusionPath      = "X-Inclusion-Path"
+	HeaderInclusionIndex     = "X-Inclusion-Index"
+	HeaderConsistencyPath    = "X-Consistency-Path"
+	HeaderOldSize            = "X-Old-Size"
+	HeaderNewSize            = "X-New-Size"
+	HeaderSignedTreeHeadTime = "X-Signed-TreeHead-Timestamp"
+	HeaderSignedTreeHeadSig  = "X-Signed-TreeHead-Signature"
+)
+
+// ProofHeaders is the typed result of parsing whichever proof-bearing
+// headers a response carries. Every field is optional: a response only
+// populates the fields relevant to the endpoint that produced it, and the
+// zero value of a field means "not present in these headers".
+type ProofHeaders struct {
+	// VerifiedTreeSize is the tree size the server asserts the response
+	// was computed against (map inclusion audit path, from
+	// X-Verified-TreeSize).
+	VerifiedTreeSize int64
+	// MapAuditPath is the map inclusion audit path from X-Verified-Proof,
+	// indexed by level, sized to mapAuditPathDepth (the map's sparse trie
+	// depth is fixed regardless of how many entries it holds).
+	MapAuditPath [][]byte
+
+	// InclusionIndex is the leaf index a log inclusion proof is for, from
+	// X-Inclusion-Index.
+	InclusionIndex int64
+	// InclusionPath is the log inclusion proof path from X-Inclusion-Path.
+	InclusionPath [][]byte
+
+	// OldSize and NewSize are the two tree sizes a consistency proof
+	// relates, from X-Old-Size and X-New-Size.
+	OldSize int64
+	NewSize int64
+	// ConsistencyPath is the log consistency proof path from
+	// X-Consistency-Path.
+	ConsistencyPath [][]byte
+
+	// SignedTreeHeadTimestamp and SignedTreeHeadSignature are the
+	// server's signature over a tree head, from
+	// X-Signed-TreeHead-Timestamp and X-Signed-TreeHead-Signature.
+	SignedTreeHeadTimestamp int64
+	SignedTreeHeadSignature []byte
+}
+
+// decodeHexStrict hex-decodes s, returning an error rather than silently
+// dropping or truncating malformed input.
+func decodeHexStrict(s string) ([]byte, error) {
+	bs, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex %q: %w", s, err)
+	}
+	return bs, nil
+}
+
+// mapAuditPathDepth is the fixed depth of the map's sparse Merkle trie: one
+// level per bit of a SHA-256 key hash. Unlike a log's inclusion/consistency
+// path, this does not grow with the number of entries in the map, so it is
+// not derived from a tree size the way auditPathDepth is.
+const mapAuditPathDepth = 256
+
+// auditPathDepth returns the number of levels a log inclusion/consistency
+// path can have for a tree of the given size: the number of bits needed to
+// index any leaf below it. A tree of size 0 or 1 has depth 0.
+func auditPathDepth(treeSize int64) int {
+	if treeSize <= 1 {
+		return 0
+	}
+	return bits.Len64(uint64(treeSize - 1))
+}
+
+// parseIndexedPath parses the "idx/hexbytes,idx/hexbytes,..." form used by
+// X-Verified-Proof into a slice sized to mapAuditPathDepth, erroring
+// (rather than silently dropping) on a malformed entry or an index the
+// map's fixed-depth trie could not produce.
+func parseIndexedPath(headers []string) ([][]byte, error) {
+	path := make([][]byte, mapAuditPathDepth)
+	for _, h := range headers {
+		for _, entry := range strings.Split(h, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			parts := strings.SplitN(entry, "/", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("malformed proof entry %q: expected \"idx/hex\"", entry)
+			}
+			idx, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+			if err != nil {
+				return nil, fmt.Errorf("malformed proof index in %q: %w", entry, err)
+			}
+			if idx < 0 || idx >= mapAuditPathDepth {
+				return nil, fmt.Errorf("proof index %d out of bounds for map audit path depth %d", idx, mapAuditPathDepth)
+			}
+			bs, err := decodeHexStrict(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			path[idx] = bs
+		}
+	}
+	return path, nil
+}
+
+// parseOrderedPath parses the plain comma-separated "hex,hex,..." form used
+// by X-Inclusion-Path and X-Consistency-Path, bounds-checking the resulting
+// path length against the max depth for a tree of the given size.
+func parseOrderedPath(headers []string, treeSize int64) ([][]byte, error) {
+	depth := auditPathDepth(treeSize)
+	var path [][]byte
+	for _, h := range headers {
+		for _, entry := range strings.Split(h, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			bs, err := decodeHexStrict(entry)
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, bs)
+		}
+	}
+	if len(path) > depth {
+		return nil, fmt.Errorf("proof path has %d entries, more than the max depth %d for tree size %d", len(path), depth, treeSize)
+	}
+	return path, nil
+}
+
+func parseOptionalInt64(headers http.Header, name string) (int64, error) {
+	v := headers.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed %s %q: %w", name, v, err)
+	}
+	return n, nil
+}
+
+// ParseProofHeaders parses every proof-bearing header understood by this
+// client out of headers into a typed ProofHeaders. It is used by Get today
+// and is intended for LogInclusionProof and consistency-proof endpoints as
+// they are added, so that each endpoint shares one canonical, strict
+// parser instead of hand-rolling its own.
+//
+// Every field is independently optional; ParseProofHeaders only errors if
+// a header that IS present is malformed (bad hex, a non-numeric index, an
+// X-Verified-Proof index outside the fixed map audit path depth, or an
+// inclusion/consistency path longer than its tree size allows).
+// X-Verified-Proof indices are not checked against X-Verified-TreeSize.
+func ParseProofHeaders(headers http.Header) (ProofHeaders, error) {
+	var ph ProofHeaders
+	var err error
+
+	ph.VerifiedTreeSize, err = parseOptionalInt64(headers, HeaderVerifiedTreeSize)
+	if err != nil {
+		return ProofHeaders{}, err
+	}
+	ph.MapAuditPath, err = parseIndexedPath(headers[http.CanonicalHeaderKey(HeaderVerifiedProof)])
+	if err != nil {
+		return ProofHeaders{}, err
+	}
+
+	ph.InclusionIndex, err = parseOptionalInt64(headers, HeaderInclusionIndex)
+	if err != nil {
+		return ProofHeaders{}, err
+	}
+	ph.InclusionPath, err = parseOrderedPath(headers[http.CanonicalHeaderKey(HeaderInclusionPath)], ph.VerifiedTreeSize)
+	if err != nil {
+		return ProofHeaders{}, err
+	}
+
+	ph.OldSize, err = parseOptionalInt64(headers, HeaderOldSize)
+	if err != nil {
+		return ProofHeaders{}, err
+	}
+	ph.NewSize, err = parseOptionalInt64(headers, HeaderNewSize)
+	if err != nil {
+		return ProofHeaders{}, err
+	}
+	ph.ConsistencyPath, err = parseOrderedPath(headers[http.CanonicalHeaderKey(HeaderConsistencyPath)], ph.NewSize)
+	if err != nil {
+		return ProofHeaders{}, err
+	}
+
+	ph.SignedTreeHeadTimestamp, err = parseOptionalInt64(headers, HeaderSignedTreeHeadTime)
+	if err != nil {
+		return ProofHeaders{}, err
+	}
+	if sig := headers.Get(HeaderSignedTreeHeadSig); sig != "" {
+		ph.SignedTreeHeadSignature, err = decodeHexStrict(sig)
+		if err != nil {
+			return ProofHeaders{}, err
+		}
+	}
+
+	return ph, nil
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseProofHeadersRoundTrip(t *testing.T) {
+	// A real map's audit path indices range up to mapAuditPathDepth-1
+	// (255) regardless of how few entries the map holds: the sparse trie
+	// is keyed by a fixed-width SHA-256 hash, not by tree size. A small
+	// VerifiedTreeSize here must not bound the accepted indices.
+	treeSize := int64(5)
+	entries := map[int][]byte{
+		0:   {0x01},
+		3:   {0x02, 0x03},
+		255: {0x04},
+	}
+
+	var parts []string
+	for idx, p := range entries {
+		parts = append(parts, fmt.Sprintf("%d/%s", idx, hex.EncodeToString(p)))
+	}
+
+	headers := http.Header{}
+	headers.Set(HeaderVerifiedTreeSize, "5")
+	headers.Set(HeaderVerifiedProof, strings.Join(parts, ","))
+
+	ph, err := ParseProofHeaders(headers)
+	if err != nil {
+		t.Fatalf("ParseProofHeaders: %v", err)
+	}
+	if ph.VerifiedTreeSize != treeSize {
+		t.Fatalf("VerifiedTreeSize = %d, want %d", ph.VerifiedTreeSize, treeSize)
+	}
+	if len(ph.MapAuditPath) != mapAuditPathDepth {
+		t.Fatalf("MapAuditPath has %d entries, want %d", len(ph.MapAuditPath), mapAuditPathDepth)
+	}
+	for idx, p := range entries {
+		if !bytes.Equal(ph.MapAuditPath[idx], p) {
+			t.Errorf("MapAuditPath[%d] = %x, want %x", idx, ph.MapAuditPath[idx], p)
+		}
+	}
+}
+
+func TestParseProofHeadersMapAuditPathRejectsOutOfRangeIndex(t *testing.T) {
+	headers := http.Header{}
+	headers.Set(HeaderVerifiedTreeSize, "5")
+	headers.Set(HeaderVerifiedProof, "256/aa")
+
+	if _, err := ParseProofHeaders(headers); err == nil {
+		t.Fatalf("expected an error for index 256, got none")
+	}
+}
+
+func TestParseProofHeadersConsistencyAndSTH(t *testing.T) {
+	headers := http.Header{}
+	headers.Set(HeaderOldSize, "4")
+	headers.Set(HeaderNewSize, "8")
+	headers.Set(HeaderConsistencyPath, "aa,bb,cc")
+	headers.Set(HeaderSignedTreeHeadTime, "1234567890")
+	headers.Set(HeaderSignedTreeHeadSig, "deadbeef")
+
+	ph, err := ParseProofHeaders(headers)
+	if err != nil {
+		t.Fatalf("ParseProofHeaders: %v", err)
+	}
+	if ph.OldSize != 4 || ph.NewSize != 8 {
+		t.Fatalf("OldSize/NewSize = %d/%d, want 4/8", ph.OldSize, ph.NewSize)
+	}
+	if len(ph.ConsistencyPath) != 3 {
+		t.Fatalf("ConsistencyPath has %d entries, want 3", len(ph.ConsistencyPath))
+	}
+	if ph.SignedTreeHeadTimestamp != 1234567890 {
+		t.Fatalf("SignedTreeHeadTimestamp = %d, want 1234567890", ph.SignedTreeHeadTimestamp)
+	}
+	if !bytes.Equal(ph.SignedTreeHeadSignature, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Fatalf("SignedTreeHeadSignature = %x, want deadbeef", ph.SignedTreeHeadSignature)
+	}
+}
+
+func TestParseProofHeadersRejectsMalformed(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers http.Header
+	}{
+		{
+			name: "bad hex in proof",
+			headers: http.Header{
+				HeaderVerifiedTreeSize: {"5"},
+				HeaderVerifiedProof:    {"0/zz"},
+			},
+		},
+		{
+			name: "non-numeric index",
+			headers: http.Header{
+				HeaderVerifiedTreeSize: {"5"},
+				HeaderVerifiedProof:    {"x/aa"},
+			},
+		},
+		{
+			name: "index out of bounds for map audit path depth",
+			headers: http.Header{
+				HeaderVerifiedTreeSize: {"2"},
+				HeaderVerifiedProof:    {"256/aa"},
+			},
+		},
+		{
+			name: "malformed tree size",
+			headers: func() http.Header {
+				h := http.Header{}
+				h.Set(HeaderVerifiedTreeSize, "not-a-number")
+				return h
+			}(),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ParseProofHeaders(c.headers); err == nil {
+				t.Fatalf("expected an error, got none")
+			}
+		})
+	}
+}
+
+func FuzzParseProofHeaders(f *testing.F) {
+	f.Add("5", "0/aa,1/bb", "aa,bb", "4", "8")
+	f.Add("0", "", "", "0", "0")
+	f.Add("not-a-number", "x/zz", "zz", "-1", "abc")
+
+	f.Fuzz(func(t *testing.T, treeSize, proof, consistency, oldSize, newSize string) {
+		headers := http.Header{}
+		headers.Set(HeaderVerifiedTreeSize, treeSize)
+		headers.Set(HeaderVerifiedProof, proof)
+		headers.Set(HeaderConsistencyPath, consistency)
+		headers.Set(HeaderOldSize, oldSize)
+		headers.Set(HeaderNewSize, newSize)
+
+		// ParseProofHeaders must never panic on arbitrary header input; an
+		// error is an entirely acceptable outcome for malformed input.
+		_, _ = ParseProofHeaders(headers)
+	})
+}
@@ -0,0 +1,226 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SnapshotOptions controls the behavior of VerifiableMap.Snapshot.
+type SnapshotOptions struct {
+	// MutationFetchOptions is passed through to the FetchEntries call used
+	// to replay the mutation log. VerifyAgainst is always overridden by
+	// Snapshot itself, so that the replayed live key set is checked
+	// against the pinned mutation log tree head rather than trusted
+	// as-is.
+	MutationFetchOptions FetchOptions
+}
+
+// snapshotManifestEntry is one line of manifest.json: a key and the leaf
+// hash of the value snapshotted for it.
+type snapshotManifestEntry struct {
+	Key      string `json:"key"`
+	LeafHash string `json:"leaf_hash"`
+}
+
+// snapshotTreeHead is the contents of treehead.json: the pinned map root
+// plus the mutation log tree head it was computed from.
+type snapshotTreeHead struct {
+	MapTreeHead         *MapTreeHead `json:"map_tree_head"`
+	MutationLogTreeHead LogTreeHead  `json:"mutation_log_tree_head"`
+}
+
+// snapshotProof is the contents of {dir}/keys/{hex}/proof.json.
+type snapshotProof struct {
+	TreeSize  int64    `json:"tree_size"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+// Snapshot materializes the full, live contents of this map at treeSize
+// into dir, in a deterministic, resumable, locally-auditable format:
+//
+//	{dir}/treehead.json        the pinned MapTreeHead and its mutation log tree head
+//	{dir}/manifest.json        every live key and its leaf hash
+//	{dir}/keys/{hex}/value     the raw value bytes for that key
+//	{dir}/keys/{hex}/proof.json  the audit path and tree size it was verified under
+//
+// It replays the mutation log from 0..treeSize to reconstruct the live key
+// set (honoring Set vs Delete), verifying the replayed entries against the
+// pinned mutation log tree head once the replay completes, then for each live key fetches
+// its value and inclusion proof and verifies the proof against the pinned
+// map root before writing anything for that key, so that a corrupt
+// snapshot can never be produced. Keys already present under {dir}/keys on
+// entry are assumed already verified and are skipped, so an interrupted
+// Snapshot can simply be re-run to resume.
+func (self *VerifiableMap) Snapshot(ctx context.Context, treeSize int64, dir string, opts SnapshotOptions, factory VerifiableEntryFactory) (*MapTreeHead, error) {
+	head, err := self.TreeHead(treeSize)
+	if err != nil {
+		return nil, err
+	}
+
+	keysDir := filepath.Join(dir, "keys")
+	if err := os.MkdirAll(keysDir, 0755); err != nil {
+		return nil, err
+	}
+
+	mutationFetchOptions := opts.MutationFetchOptions
+	mutationFetchOptions.VerifyAgainst = &head.MutationLogTreeHead
+	liveKeys, err := self.replayLiveKeySet(ctx, head.MutationLogTreeHead.TreeSize, mutationFetchOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := alreadySnapshottedKeys(keysDir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := make([]snapshotManifestEntry, 0, len(liveKeys))
+	for _, key := range liveKeys {
+		hexKey := hex.EncodeToString(key)
+		if done[hexKey] {
+			leafHash, err := readExistingLeafHash(keysDir, hexKey)
+			if err != nil {
+				return nil, err
+			}
+			manifest = append(manifest, snapshotManifestEntry{Key: hexKey, LeafHash: hex.EncodeToString(leafHash)})
+			continue
+		}
+
+		proof, err := self.Get(key, treeSize, factory)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyMapInclusionProof(key, proof, head.RootHash); err != nil {
+			return nil, fmt.Errorf("snapshot: key %s: %w", hexKey, err)
+		}
+
+		leafHash := leafMerkleTreeHash(proof.Value.Data())
+		if err := writeSnapshottedKey(keysDir, hexKey, proof); err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, snapshotManifestEntry{Key: hexKey, LeafHash: hex.EncodeToString(leafHash)})
+	}
+
+	if err := writeJSONFile(filepath.Join(dir, "manifest.json"), manifest); err != nil {
+		return nil, err
+	}
+	if err := writeJSONFile(filepath.Join(dir, "treehead.json"), &snapshotTreeHead{
+		MapTreeHead:         head,
+		MutationLogTreeHead: head.MutationLogTreeHead,
+	}); err != nil {
+		return nil, err
+	}
+
+	return head, nil
+}
+
+// replayLiveKeySet replays the mutation log [0, treeSize) via FetchEntries,
+// honoring Set vs Delete, and returns the resulting set of live keys.
+func (self *VerifiableMap) replayLiveKeySet(ctx context.Context, treeSize int64, opts FetchOptions) ([][]byte, error) {
+	live := map[string][]byte{}
+
+	out, errc := self.MutationLog().FetchEntries(ctx, 0, treeSize, RawDataEntryFactory, opts)
+	for entry := range out {
+		var rec mutationRecord
+		if err := json.Unmarshal(entry.Entry.Data(), &rec); err != nil {
+			return nil, fmt.Errorf("replaying mutation log entry %d: %w", entry.Index, err)
+		}
+		key, err := hex.DecodeString(rec.Key)
+		if err != nil {
+			return nil, fmt.Errorf("replaying mutation log entry %d: %w", entry.Index, err)
+		}
+		switch MutationKind(rec.Action) {
+		case SetMutation:
+			live[rec.Key] = key
+		case DeleteMutation:
+			delete(live, rec.Key)
+		default:
+			return nil, fmt.Errorf("replaying mutation log entry %d: unknown action %q", entry.Index, rec.Action)
+		}
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, 0, len(live))
+	for _, key := range live {
+		keys = append(keys, key)
+	}
+	// Go map iteration order is randomized per run; sort so that the
+	// snapshot's manifest and the order keys are written in is
+	// deterministic across runs of the same input.
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return keys, nil
+}
+
+func alreadySnapshottedKeys(keysDir string) (map[string]bool, error) {
+	entries, err := ioutil.ReadDir(keysDir)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(keysDir, e.Name(), "value")); err == nil {
+			if _, err := os.Stat(filepath.Join(keysDir, e.Name(), "proof.json")); err == nil {
+				done[e.Name()] = true
+			}
+		}
+	}
+	return done, nil
+}
+
+func readExistingLeafHash(keysDir, hexKey string) ([]byte, error) {
+	value, err := ioutil.ReadFile(filepath.Join(keysDir, hexKey, "value"))
+	if err != nil {
+		return nil, err
+	}
+	return leafMerkleTreeHash(value), nil
+}
+
+func writeSnapshottedKey(keysDir, hexKey string, proof *MapInclusionProof) error {
+	keyDir := filepath.Join(keysDir, hexKey)
+	if err := os.MkdirAll(keyDir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(keyDir, "value"), proof.Value.Data(), 0644); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(keyDir, "proof.json"), &snapshotProof{
+		TreeSize:  proof.TreeSize,
+		AuditPath: proof.AuditPath,
+	})
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	contents, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}